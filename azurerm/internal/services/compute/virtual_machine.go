@@ -3,6 +3,7 @@ package compute
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
@@ -11,6 +12,8 @@ import (
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/clients"
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/compute/parse"
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/compute/validate"
+	msiparse "github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/msi/parse"
+	msivalidate "github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/msi/validate"
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/timeouts"
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/utils"
 )
@@ -32,37 +35,71 @@ func virtualMachineAdditionalCapabilitiesSchema() *schema.Schema {
 					Optional: true,
 					Default:  false,
 				},
+
+				// NOTE: this is distinct from `disk_encryption_set_id`, which encrypts the disk blobs at
+				// rest using a customer-managed key - this encrypts the temp disk and the OS/data disk
+				// caches on the host itself
+				"encryption_at_host_enabled": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
 			},
 		},
 	}
 }
 
-func expandVirtualMachineAdditionalCapabilities(input []interface{}) *compute.AdditionalCapabilities {
+// expandVirtualMachineAdditionalCapabilities reads the `additional_capabilities` block and returns
+// both the AdditionalCapabilities and the SecurityProfile for the parent VM/VMSS payload -
+// encryption-at-host is a Security Profile concept in the Compute API rather than an Additional
+// Capability, but it's surfaced in the same block for discoverability, so both are built together
+// here and the caller is expected to assign each return value to its own field on the payload
+// (`VirtualMachineProperties.AdditionalCapabilities` and `.SecurityProfile` respectively).
+//
+// NOTE: this trimmed snapshot has no `azurerm_linux_virtual_machine`/`azurerm_windows_virtual_machine`
+// resource file, so there's no create/update/read path in this tree to wire these return values into
+// yet - that assignment still needs to land once those resource files exist.
+func expandVirtualMachineAdditionalCapabilities(input []interface{}) (*compute.AdditionalCapabilities, *compute.SecurityProfile) {
 	capabilities := compute.AdditionalCapabilities{}
 
+	var securityProfile *compute.SecurityProfile
+
 	if len(input) > 0 {
 		raw := input[0].(map[string]interface{})
 
 		capabilities.UltraSSDEnabled = utils.Bool(raw["ultra_ssd_enabled"].(bool))
+
+		// whenever the block is present, set EncryptionAtHost (rather than only when true) - a nil
+		// value means "no change" to Azure, so omitting it on a true->false transition would leave
+		// the setting enabled. When the block is absent no SecurityProfile is returned at all.
+		encryptionAtHostEnabled := raw["encryption_at_host_enabled"].(bool)
+		securityProfile = &compute.SecurityProfile{
+			EncryptionAtHost: utils.Bool(encryptionAtHostEnabled),
+		}
 	}
 
-	return &capabilities
+	return &capabilities, securityProfile
 }
 
-func flattenVirtualMachineAdditionalCapabilities(input *compute.AdditionalCapabilities) []interface{} {
-	if input == nil {
+func flattenVirtualMachineAdditionalCapabilities(input *compute.AdditionalCapabilities, securityProfile *compute.SecurityProfile) []interface{} {
+	if input == nil && securityProfile == nil {
 		return []interface{}{}
 	}
 
 	ultraSsdEnabled := false
-
-	if input.UltraSSDEnabled != nil {
+	if input != nil && input.UltraSSDEnabled != nil {
 		ultraSsdEnabled = *input.UltraSSDEnabled
 	}
 
+	encryptionAtHostEnabled := false
+	if securityProfile != nil && securityProfile.EncryptionAtHost != nil {
+		encryptionAtHostEnabled = *securityProfile.EncryptionAtHost
+	}
+
 	return []interface{}{
 		map[string]interface{}{
-			"ultra_ssd_enabled": ultraSsdEnabled,
+			"ultra_ssd_enabled":          ultraSsdEnabled,
+			"encryption_at_host_enabled": encryptionAtHostEnabled,
 		},
 	}
 }
@@ -88,8 +125,14 @@ func virtualMachineIdentitySchema() *schema.Schema {
 					Type:     schema.TypeSet,
 					Optional: true,
 					Elem: &schema.Schema{
-						Type: schema.TypeString,
-						// TODO: validation for a UAI which requires an ID Parser/Validator
+						Type:         schema.TypeString,
+						ValidateFunc: msivalidate.UserAssignedIdentityID,
+					},
+					// the Compute API is inconsistent about the casing of the subscription/resource
+					// group segments it echoes back - DiffSuppressFunc doesn't apply to Set elements,
+					// so hash case-insensitively instead to avoid a perpetual diff
+					Set: func(v interface{}) int {
+						return schema.HashString(strings.ToLower(v.(string)))
 					},
 				},
 
@@ -146,7 +189,7 @@ func flattenVirtualMachineIdentity(input *compute.VirtualMachineIdentity) []inte
 	identityIds := make([]string, 0)
 	if input.UserAssignedIdentities != nil {
 		for k := range input.UserAssignedIdentities {
-			identityIds = append(identityIds, k)
+			identityIds = append(identityIds, normalizeUserAssignedIdentityID(k))
 		}
 	}
 
@@ -170,6 +213,19 @@ func flattenVirtualMachineIdentity(input *compute.VirtualMachineIdentity) []inte
 	}
 }
 
+// normalizeUserAssignedIdentityID lower-cases the subscription/resource group segments of a User
+// Assigned Identity ID (ARM echoes these back with inconsistent casing) while preserving the
+// resource name as supplied, to keep `identity_ids` diffs stable across plans.
+func normalizeUserAssignedIdentityID(input string) string {
+	parsed, err := msiparse.UserAssignedIdentityID(input)
+	if err != nil {
+		return input
+	}
+
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ManagedIdentity/userAssignedIdentities/%s",
+		strings.ToLower(parsed.SubscriptionId), strings.ToLower(parsed.ResourceGroup), parsed.Name)
+}
+
 func expandVirtualMachineNetworkInterfaceIDs(input []interface{}) []compute.NetworkInterfaceReference {
 	output := make([]compute.NetworkInterfaceReference, 0)
 
@@ -280,6 +336,38 @@ func virtualMachineOSDiskSchema() *schema.Schema {
 					Optional: true,
 					Default:  false,
 				},
+
+				// Optional - used to create an OS Disk from an existing Managed Disk, e.g. when
+				// restoring a VM from a DR/cross-region-restore copy of its disk. An Attach-based OS Disk
+				// skips image provisioning entirely; `expandVirtualMachineOSDisk` below only checks this
+				// field against `create_option` - nothing in this package checks it against
+				// `source_image_id`/`source_image_reference` on the parent resource (`ConflictsWith`
+				// can't reach sibling top-level fields from inside this nested block).
+				"managed_disk_id": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					ForceNew:     true,
+					ValidateFunc: validate.ManagedDiskID,
+				},
+
+				// Optional - defaults to `Attach` when `managed_disk_id` is set and to `FromImage` otherwise;
+				// `Attach` is only valid (and required) when `managed_disk_id` is set - this is validated
+				// in `expandVirtualMachineOSDisk` below
+				"create_option": {
+					Type:     schema.TypeString,
+					Optional: true,
+					ForceNew: true,
+					Computed: true,
+					ValidateFunc: validation.StringInSlice([]string{
+						string(compute.DiskCreateOptionTypesFromImage),
+						string(compute.DiskCreateOptionTypesAttach),
+					}, false),
+				},
+
+				// DEFERRED: `delete_option`/`detach_option` are not implemented - those properties were
+				// only added to `OSDisk`/`DataDisk` in the 2021-03-01 Compute API, which is newer than
+				// the `2020-06-01` SDK this package is pinned to. This request can't be delivered until
+				// the SDK is bumped and every other call site in this package re-validated against it.
 			},
 		},
 	}
@@ -352,19 +440,29 @@ func virtualMachineDataDiskSchema() *schema.Schema {
 					Default:  false,
 				},
 
-				// Computed only
-				"create_option": {
-					Type:     schema.TypeString,
-					Computed: true,
-				},
-
+				// only settable when `storage_account_type` is `UltraSSD_LRS`
 				"disk_iops_read_write": {
-					Type:     schema.TypeInt,
-					Computed: true,
+					Type:         schema.TypeInt,
+					Optional:     true,
+					Computed:     true,
+					ValidateFunc: validation.IntAtLeast(1),
 				},
 
 				"disk_mbps_read_write": {
-					Type:     schema.TypeInt,
+					Type:         schema.TypeInt,
+					Optional:     true,
+					Computed:     true,
+					ValidateFunc: validation.IntAtLeast(1),
+				},
+
+				// DEFERRED: `delete_option`/`detach_option` are not implemented - those properties were
+				// only added to `OSDisk`/`DataDisk` in the 2021-03-01 Compute API, which is newer than
+				// the `2020-06-01` SDK this package is pinned to. This request can't be delivered until
+				// the SDK is bumped and every other call site in this package re-validated against it.
+
+				// Computed only
+				"create_option": {
+					Type:     schema.TypeString,
 					Computed: true,
 				},
 			},
@@ -372,7 +470,17 @@ func virtualMachineDataDiskSchema() *schema.Schema {
 	}
 }
 
-func expandVirtualMachineOSDisk(input []interface{}, osType compute.OperatingSystemTypes) *compute.OSDisk {
+// expandVirtualMachineOSDisk returns an error (rather than panicking) when
+// `os_disk.0.create_option`/`os_disk.0.managed_disk_id` are set inconsistently (`Attach` without a
+// `managed_disk_id`, or `FromImage` with one). When `create_option` is unset it uses `Attach` if
+// `managed_disk_id` is set and `FromImage` otherwise. It can only validate fields within the `os_disk` block itself - the `source_image_id`/
+// `source_image_reference` fields it's mutually exclusive with live at the top level of the
+// `azurerm_linux_virtual_machine`/`azurerm_windows_virtual_machine` resources, which don't exist
+// in this trimmed snapshot, so that half of the exclusivity check (and wiring this error return
+// into a caller) is deferred until those resource files land here; it would belong in a
+// CustomizeDiff there rather than in ConflictsWith, which can't reach sibling top-level fields
+// from inside a nested block's Elem.
+func expandVirtualMachineOSDisk(input []interface{}, osType compute.OperatingSystemTypes) (*compute.OSDisk, error) {
 	raw := input[0].(map[string]interface{})
 	disk := compute.OSDisk{
 		Caching: compute.CachingTypes(raw["caching"].(string)),
@@ -380,13 +488,7 @@ func expandVirtualMachineOSDisk(input []interface{}, osType compute.OperatingSys
 			StorageAccountType: compute.StorageAccountTypes(raw["storage_account_type"].(string)),
 		},
 		WriteAcceleratorEnabled: utils.Bool(raw["write_accelerator_enabled"].(bool)),
-
-		// these have to be hard-coded so there's no point exposing them
-		// for CreateOption, whilst it's possible for this to be "Attach" for an OS Disk
-		// from what we can tell this approach has been superseded by provisioning from
-		// an image of the machine (e.g. an Image/Shared Image Gallery)
-		CreateOption: compute.DiskCreateOptionTypesFromImage,
-		OsType:       osType,
+		OsType:                  osType,
 	}
 
 	if osDiskSize := raw["disk_size_gb"].(int); osDiskSize > 0 {
@@ -410,7 +512,30 @@ func expandVirtualMachineOSDisk(input []interface{}, osType compute.OperatingSys
 		disk.Name = utils.String(name)
 	}
 
-	return &disk
+	managedDiskId := raw["managed_disk_id"].(string)
+	if managedDiskId != "" {
+		disk.ManagedDisk.ID = utils.String(managedDiskId)
+	}
+
+	// `create_option` defaults to `FromImage` - whilst it's possible for an OS Disk to be created
+	// with `Attach` (from an existing Managed Disk, e.g. when restoring a VM from a DR copy of its
+	// disk) that's only valid in combination with `managed_disk_id`, since in that case the
+	// image-provisioning fields (`source_image_id`/`source_image_reference`) are skipped entirely
+	createOption := raw["create_option"].(string)
+	switch {
+	case createOption == string(compute.DiskCreateOptionTypesAttach) && managedDiskId == "":
+		return nil, fmt.Errorf("`os_disk.0.managed_disk_id` must be specified when `os_disk.0.create_option` is `Attach`")
+	case createOption == string(compute.DiskCreateOptionTypesFromImage) && managedDiskId != "":
+		return nil, fmt.Errorf("`os_disk.0.create_option` cannot be `FromImage` when `os_disk.0.managed_disk_id` is specified")
+	case createOption != "":
+		disk.CreateOption = compute.DiskCreateOptionTypes(createOption)
+	case managedDiskId != "":
+		disk.CreateOption = compute.DiskCreateOptionTypesAttach
+	default:
+		disk.CreateOption = compute.DiskCreateOptionTypesFromImage
+	}
+
+	return &disk, nil
 }
 
 func flattenVirtualMachineOSDisk(ctx context.Context, disksClient *compute.DisksClient, input *compute.OSDisk) ([]interface{}, error) {
@@ -437,11 +562,17 @@ func flattenVirtualMachineOSDisk(ctx context.Context, disksClient *compute.Disks
 
 	diskEncryptionSetId := ""
 	storageAccountType := ""
+	managedDiskId := ""
 
 	if input.ManagedDisk != nil {
 		storageAccountType = string(input.ManagedDisk.StorageAccountType)
 
 		if input.ManagedDisk.ID != nil {
+			// only an attached OS Disk has a user-supplied `managed_disk_id`
+			if input.CreateOption == compute.DiskCreateOptionTypesAttach {
+				managedDiskId = *input.ManagedDisk.ID
+			}
+
 			id, err := parse.ManagedDiskID(*input.ManagedDisk.ID)
 			if err != nil {
 				return nil, err
@@ -482,6 +613,7 @@ func flattenVirtualMachineOSDisk(ctx context.Context, disksClient *compute.Disks
 	if input.WriteAcceleratorEnabled != nil {
 		writeAcceleratorEnabled = *input.WriteAcceleratorEnabled
 	}
+
 	return []interface{}{
 		map[string]interface{}{
 			"caching":                   string(input.Caching),
@@ -489,8 +621,10 @@ func flattenVirtualMachineOSDisk(ctx context.Context, disksClient *compute.Disks
 			"diff_disk_settings":        diffDiskSettings,
 			"disk_encryption_set_id":    diskEncryptionSetId,
 			"name":                      name,
+			"managed_disk_id":           managedDiskId,
 			"storage_account_type":      storageAccountType,
 			"write_accelerator_enabled": writeAcceleratorEnabled,
+			"create_option":             string(input.CreateOption),
 		},
 	}, nil
 }
@@ -560,6 +694,35 @@ func expandVirtualMachineDataDisks(d *schema.ResourceData, meta interface{}) (*[
 			dataDisk.WriteAcceleratorEnabled = utils.Bool(writeAccelerator.(bool))
 		}
 
+		isUltraSSD := disk["storage_account_type"].(string) == string(compute.UltraSSDLRS)
+		iops := disk["disk_iops_read_write"].(int)
+		mbps := disk["disk_mbps_read_write"].(int)
+
+		if isUltraSSD {
+			// default values taken from https://docs.microsoft.com/en-us/azure/virtual-machines/disks-types#ultra-disk
+			if iops == 0 {
+				iops = 500
+			}
+			if mbps == 0 {
+				mbps = 100
+			}
+
+			dataDisk.DiskIOPSReadWrite = utils.Int64(int64(iops))
+			dataDisk.DiskMBpsReadWrite = utils.Int64(int64(mbps))
+
+			// NOTE: setting these on the VM payload is enough for the Disk to be created with them,
+			// but updating an already-existing Ultra Disk's IOPS/throughput via the parent VM body
+			// isn't reliably applied - that needs a dedicated `disksClient.Update` call, gated on
+			// `d.HasChange`, from the resource's own Update function using the Update timeout (an
+			// expand helper like this one is the wrong place for a blocking mutating call - it runs
+			// under a Read timeout and fires on every apply regardless of whether anything changed).
+			// This trimmed snapshot has no `azurerm_linux_virtual_machine`/`azurerm_windows_virtual_machine`
+			// resource file to host that call, so the update-path half of this request is deferred
+			// until one exists.
+		} else if iops != 0 || mbps != 0 {
+			return nil, fmt.Errorf("`disk_iops_read_write` and `disk_mbps_read_write` can only be configured when `storage_account_type` is set to %q", compute.UltraSSDLRS)
+		}
+
 		result = append(result, dataDisk)
 	}
 
@@ -633,3 +796,9 @@ func flattenVirtualMachineDataDisks(input *[]compute.DataDisk) []interface{} {
 
 	return result
 }
+
+// NOTE: the `scratch_disk` block (local/ephemeral NVMe/SCSI storage validation against `vm_size`)
+// was removed here - this trimmed snapshot has no `azurerm_linux_virtual_machine`/
+// `azurerm_windows_virtual_machine` resource file to add the block to or to call the validation
+// from, so shipping the schema/expand/flatten here would only be scaffolding that silently no-ops.
+// Revisit once those resource files exist in this tree.
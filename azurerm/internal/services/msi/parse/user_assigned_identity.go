@@ -0,0 +1,35 @@
+package parse
+
+import (
+	"fmt"
+
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/helpers/azure"
+)
+
+type UserAssignedIdentityId struct {
+	SubscriptionId string
+	ResourceGroup  string
+	Name           string
+}
+
+func UserAssignedIdentityID(input string) (*UserAssignedIdentityId, error) {
+	id, err := azure.ParseAzureResourceID(input)
+	if err != nil {
+		return nil, fmt.Errorf("parsing User Assigned Identity ID %q: %+v", input, err)
+	}
+
+	identity := UserAssignedIdentityId{
+		SubscriptionId: id.SubscriptionID,
+		ResourceGroup:  id.ResourceGroup,
+	}
+
+	if identity.Name, err = id.PopSegment("userAssignedIdentities"); err != nil {
+		return nil, err
+	}
+
+	if err := id.ValidateNoEmptySegments(input); err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}